@@ -25,8 +25,13 @@ fn main() {
         .unwrap()
         .write_all(include_bytes!("link.x"))
         .unwrap();
+    fs::File::create(out_dir.join("fonts.x"))
+        .unwrap()
+        .write_all(include_bytes!("fonts.x"))
+        .unwrap();
     println!("cargo:rustc-link-search={}", out_dir.display());
 
     println!("cargo:rerun-if-changed=build.rs");
     println!("cargo:rerun-if-changed=link.x");
+    println!("cargo:rerun-if-changed=fonts.x");
 }
@@ -7,6 +7,8 @@ MEMORY
 /*
 Fonts go from 0x2052_0000 to 0x2098_0000
 */
+/* _font_base and _font_total_len are generated by src/generate_fonts.py */
+INCLUDE fonts.x
 
 REGION_ALIAS("REGION_TEXT", FLASH);
 REGION_ALIAS("REGION_RODATA", FLASH);
@@ -92,7 +94,9 @@ SECTIONS
 
   .fonts ALIGN(131072) : SUBALIGN(131072)
   {
+      _sfonts = .;
       KEEP(*(.fontdata));
+      _efonts = .;
   } > REGION_RODATA
 
   .bss (NOLOAD) :
@@ -136,6 +140,15 @@ SECTIONS
   }
 }
 
+ASSERT(_sfonts == _font_base, "
+ERROR(loader): the .fonts section does not start at the FONT_BASE used by the
+graphics-server. Re-run src/generate_fonts.py or adjust the code size before the
+.fonts section.");
+
+ASSERT(_efonts - _sfonts == _font_total_len, "
+ERROR(loader): the .fonts section size does not match FONT_TOTAL_LEN; the glyph data
+is out of date. Re-run src/generate_fonts.py.");
+
 /* Do not exceed this mark in the error messages above                                    | */
 ASSERT(ORIGIN(REGION_TEXT) % 4 == 0, "
 ERROR(riscv-rt): the start of the REGION_TEXT must be 4-byte aligned");
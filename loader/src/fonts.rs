@@ -5,3 +5,15 @@ pub mod emoji;
 pub mod hanzi;
 pub mod regular;
 pub mod small;
+
+/// Wrapper that places each font's data on a 4-byte boundary.
+#[repr(C, align(4))]
+pub struct FontData<T>(pub T);
+
+#[allow(dead_code)]
+pub const FONT_TOTAL_CRC32: u32 = 0xba6c4216;
+// Generated from blitstr revision unknown with --align 4
+#[allow(dead_code)]
+pub const FONT_SOURCE_REV: Option<&str> = None;
+#[allow(dead_code)]
+pub const FONT_SOURCE_SHA256: &str = "db362308fb6d40633a10c33860444deb7680a559f25a02f681f825d19c758154";
@@ -1,4 +1,5 @@
 // This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit.
+// Generated from blitstr revision unknown with --align 4
 #[allow(dead_code)]
 #[link_section=".fontdata"]
 #[no_mangle]
@@ -13,7 +14,7 @@
 ///  h: Height of pattern in pixels
 ///  yOffset: Vertical offset (pixels downward from top of line) to position
 ///     glyph pattern properly relative to text baseline
-pub static DATA_EMOJI: [u32; 91228] = [
+pub static DATA_EMOJI: super::FontData<[u32; 91228]> = super::FontData([
     // [0]: 1f004 "🀄"
     0x00171f01, 0x92492492, 0x49200000, 0x0492c924, 0x92492006, 0x00249649, 0x24924909, 0x30016db6,
     0x49e4b6ca, 0xc1870b25, 0x964b2492, 0x420c304b, 0x6cb24b6d, 0x92006902, 0x49649249, 0x24900300,
@@ -15859,4 +15860,6 @@ pub static DATA_EMOJI: [u32; 91228] = [
     0x6d964000, 0x6b240009, 0x65924009, 0x65b20000, 0x40200049, 0x24920049, 0x24900000, 0x0800025b,
     0x6d9002fb, 0x6f800f92, 0x4bc01249, 0x24801249, 0x24000000, 0x00059249, 0x25849249, 0x24c80000,
     0x096c9249, 0x2d249249, 0x26400000, 0x4b649249, 0x69249249, 0x32000002, 0x5924924b, 0x08000009,
-];
+]);
+#[allow(dead_code)]
+pub const CRC32_EMOJI: u32 = 0x89b9560c;
@@ -1,4 +1,5 @@
 // This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit.
+// Generated from blitstr revision unknown with --align 4
 #[allow(dead_code)]
 #[link_section=".fontdata"]
 #[no_mangle]
@@ -13,7 +14,7 @@
 ///  h: Height of pattern in pixels
 ///  yOffset: Vertical offset (pixels downward from top of line) to position
 ///     glyph pattern properly relative to text baseline
-pub static DATA_HANZI: [u32; 276441] = [
+pub static DATA_HANZI: super::FontData<[u32; 276441]> = super::FontData([
     // [0]: 3447 "㑇"
     0x00202000, 0x00000000, 0x00000000, 0x00000000, 0x00018300, 0x00018380, 0x0001c380, 0x00ffc180,
     0x00ffe1c0, 0x00e070c0, 0x007070e0, 0x007038e0, 0x00381cf0, 0x00180ef8, 0x01fffcfc, 0x01fff8fc,
@@ -50276,4 +50277,6 @@ pub static DATA_HANZI: [u32; 276441] = [
     0x00000cc0, 0x00000cc0, 0x00000cc0, 0x00000cc0, 0x00000cc0, 0x00000ce0, 0x00000660, 0x00000660,
     0x00000770, 0x00000330, 0x00000398, 0x00000198, 0x000001cc, 0x00000080, 0x00000000, 0x00000000,
     0x00000000,
-];
+]);
+#[allow(dead_code)]
+pub const CRC32_HANZI: u32 = 0xe6099367;
@@ -1,4 +1,5 @@
 // This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit.
+// Generated from blitstr revision unknown with --align 4
 #[allow(dead_code)]
 #[link_section=".fontdata"]
 #[no_mangle]
@@ -13,7 +14,7 @@
 ///  h: Height of pattern in pixels
 ///  yOffset: Vertical offset (pixels downward from top of line) to position
 ///     glyph pattern properly relative to text baseline
-pub static DATA_SMALL: [u32; 1071] = [
+pub static DATA_SMALL: super::FontData<[u32; 1071]> = super::FontData([
     // [0]: 20 " "
     0x0004020b, 0x00000000,
     // [2]: 21 "!"
@@ -432,4 +433,6 @@ pub static DATA_SMALL: [u32; 1071] = [
     // [1058]: FFFD "�"
     0x00121402, 0x00c00030, 0x003f000f, 0xc00f3c03, 0xcf03ccf0, 0xf33cfcff, 0xff3ffff3, 0xfffcff3f,
     0xff0fffc0, 0xf3c03cf0, 0x03f000fc, 0x000c0003, 0x00000000,
-];
+]);
+#[allow(dead_code)]
+pub const CRC32_SMALL: u32 = 0xf10e15ad;
@@ -1,10 +1,19 @@
 #!/usr/bin/python3
 
 import argparse
+import contextlib
+import difflib
+import hashlib
+import io
+import json
 import subprocess
 import os
 import sys
+import tempfile
+import time
 import re
+import struct
+import zlib
 from collections import OrderedDict
 
 """
@@ -24,67 +33,1086 @@ hard-codes the location of the graphics-server crate to encode the locations of
 It also, by default, assumes that the `blitstr` crate is cloned into a directory at the
 same level as xous-core, but this can be changed with the `-d` command line argument.
 """
+FONTMAP_RS = '../../services/graphics-server/src/fontmap.rs'
+FONTMAP_JSON = '../../services/graphics-server/src/fontmap.json'
+
+FONT_LIMIT = 0x20980000 # end of the FLASH reserved for fonts, see loader/link.x
+
+IMAGE_MAGIC = 0x544e4658 # "XFNT"
+IMAGE_VERSION = 1
+IMAGE_HEADER_LEN = 28
+IMAGE_BUILD_ID_OFFSET = 24
+IMAGE_NAME_LEN = 8
+
+def image_header(fontdict, offsetdict, crcdict, total_crc, data_len, build_id):
+    directory = bytearray()
+    for k,v in fontdict.items():
+        directory += k.encode('ascii')[:IMAGE_NAME_LEN].ljust(IMAGE_NAME_LEN, b'\0')
+        directory += struct.pack('<III', offsetdict[k], int(v) * 4, crcdict[k])
+    header = struct.pack('<IIIIIII', IMAGE_MAGIC, IMAGE_VERSION, IMAGE_HEADER_LEN + len(directory),
+        data_len, total_crc, len(fontdict), build_id)
+    return header + directory
+
+def write_ihex(filename, base, data):
+    with open(filename, 'w') as hexfile:
+        def record(rtype, addr, payload):
+            rec = bytes([len(payload), (addr >> 8) & 0xff, addr & 0xff, rtype]) + payload
+            hexfile.write(":{}{:02X}\n".format(rec.hex().upper(), (-sum(rec)) & 0xff))
+        upper = None
+        for i in range(0, len(data), 16):
+            addr = base + i
+            if (addr >> 16) != upper:
+                upper = addr >> 16
+                record(4, 0, struct.pack('>H', upper))
+            record(0, addr & 0xffff, bytes(data[i:i+16]))
+        record(1, 0, b'')
+
+GLYPH_COMMENT = re.compile(r'\s*// \[\d+\]: ([0-9a-fA-F]+(?:-[0-9a-fA-F]+)*)')
+WORD = re.compile('0x[0-9a-fA-F]{8}')
+
+outputs = OrderedDict([]) # generated file name -> contents, written out at the end of the run
+out_dir = None # when set, generated files go under this directory instead of the xous-core tree
+
+class FontError(Exception):
+    """A problem with the font sources, reported with the file (and line, where known) it came from."""
+    def __init__(self, filename, message, lineno=None):
+        where = filename if lineno is None else "{}:{}".format(filename, lineno)
+        Exception.__init__(self, "{}: {}".format(where, message))
+        self.filename = filename
+        self.lineno = lineno
+
+class CodepointError(ValueError):
+    """A codepoint or range given on the command line that cannot be parsed."""
+
+log_format = 'text'
+LOG_LEVELS = ['error', 'warning', 'info', 'debug']
+log_level = 'info'
+
+def event(kind, message, level=None, **fields):
+    """Report progress as plain text, or as one JSON object per line with --log-format=json.
+
+    Events are dropped when their level is below --log-level; 'error' and 'warning' events take
+    that level unless told otherwise, anything else defaults to 'info'. 'result' events carry the
+    output a report mode was asked for, and are never dropped. As text, only results go to stdout and
+    everything else to stderr, so that a report or --dry-run diff can be redirected on its own."""
+    if level is None:
+        level = kind if kind in ('error', 'warning') else 'info'
+    if level != 'result' and LOG_LEVELS.index(level) > LOG_LEVELS.index(log_level):
+        return
+    if log_format == 'json':
+        record = OrderedDict([('event', kind), ('level', level)])
+        for key in sorted(fields.keys()):
+            record[key] = fields[key]
+        record['message'] = message
+        print(json.dumps(record))
+        sys.stdout.flush()
+    elif level == 'result':
+        print(message)
+        sys.stdout.flush()
+    else:
+        sys.stdout.flush() # keep the order of anything already printed
+        print("{}: {}".format(level, message) if level in ('error', 'warning') else message, file=sys.stderr)
+        sys.stderr.flush()
+
+def destination(filename):
+    """Where a generated file (named relative to loader/src) lives on disk."""
+    if out_dir is None:
+        return filename
+    return os.path.join(out_dir, os.path.normpath(os.path.join('loader/src', filename)))
+
+@contextlib.contextmanager
+def output(filename):
+    buf = io.StringIO()
+    yield buf
+    outputs[filename] = buf.getvalue()
+
+def glyph_records(text):
+    """Map each record key in a generated font file to the words of its glyph record. A key is the
+    codepoint in hex, or for a multi-codepoint emoji sequence such as a flag, the codepoints joined by '-'."""
+    records = OrderedDict([])
+    words = None
+    for line in text.splitlines():
+        comment = GLYPH_COMMENT.match(line)
+        if comment:
+            words = records.setdefault(comment.group(1).lower(), [])
+        elif words is not None:
+            if line.strip().startswith(']'):
+                break
+            words += WORD.findall(line.split('//')[0])
+    return records
+
+def record_name(key):
+    """Name a record key the Unicode way, e.g. U+0041 or U+1F1E6-1F1E8."""
+    return 'U+' + '-'.join([cp.upper().zfill(4) for cp in key.split('-')])
+
+def parse_codepoint(arg):
+    """Accept U+4E2D, 0x4e2d or a literal character."""
+    if len(arg) == 1:
+        return ord(arg)
+    try:
+        if arg[:2].lower() in ('u+', '0x'):
+            return int(arg[2:], 16)
+        return int(arg, 16)
+    except ValueError:
+        raise CodepointError("'{}' is not a codepoint; use U+4E2D, 0x4e2d or the character itself".format(arg))
+
+def glyph_bitmap(words):
+    """Unpack a glyph record into rows of '#' and '.'; see the record format in the font files.
+
+    Each row's pixels are stored rightmost first, which is how blitstr draws them."""
+    header = int(words[0], 16)
+    w = (header >> 16) & 0xff
+    h = (header >> 8) & 0xff
+    bits = [int(word, 16) for word in words[1:]]
+    rows = []
+    for y in range(h):
+        row = ''
+        for x in range(w):
+            i = y * w + (w - 1 - x)
+            row += '#' if (bits[i // 32] >> (31 - (i % 32))) & 1 else '.'
+        rows.append(row)
+    return rows
+
+def write_png(filename, rows, scale):
+    """Write rows of '#' and '.' as an 8-bit grayscale PNG, black on white."""
+    if len(rows) == 0 or len(rows[0]) == 0 or scale < 1:
+        raise ValueError("a PNG needs at least one pixel") # callers check for empty glyphs first
+    width = len(rows[0]) * scale
+    raw = bytearray()
+    for row in rows:
+        line = bytearray([0]) # filter type: none
+        for px in row:
+            line += bytes([0x00 if px == '#' else 0xff]) * scale
+        raw += line * scale
+    def chunk(ctype, data):
+        body = ctype + data
+        return struct.pack('>I', len(data)) + body + struct.pack('>I', zlib.crc32(body))
+    with open(filename, 'wb') as pngfile:
+        pngfile.write(b'\x89PNG\r\n\x1a\n')
+        pngfile.write(chunk(b'IHDR', struct.pack('>IIBBBBB', width, len(rows) * scale, 8, 0, 0, 0, 0)))
+        pngfile.write(chunk(b'IDAT', zlib.compress(bytes(raw))))
+        pngfile.write(chunk(b'IEND', b''))
+
+def extract_glyph(fontdict, arg, font, filename, scale):
+    """Write one glyph out as a PNG, from the named font or the first one that has it."""
+    cp = parse_codepoint(arg)
+    key = '{:x}'.format(cp)
+    for k in fontdict.keys():
+        if font is not None and k != font:
+            continue
+        records = glyph_records(outputs['fonts/{}.rs'.format(k)])
+        if key in records:
+            rows = glyph_bitmap(records[key])
+            if len(rows) == 0 or len(rows[0]) == 0:
+                event('error', "U+{:04X} in {} is an empty glyph; there is nothing to write".format(cp, k), codepoint=cp, font=k)
+                return 1
+            if filename is None:
+                filename = 'U+{:04X}_{}.png'.format(cp, k)
+            write_png(filename, rows, scale)
+            event('file_written', "Wrote U+{:04X} from {} at {}x to {}".format(cp, k, scale, filename),
+                file=filename, codepoint=cp, font=k, scale=scale)
+            return 0
+    event('not_found', "U+{:04X} is not in {}".format(cp, 'any font' if font is None else font),
+        level='warning', codepoint=cp, font=font)
+    return 1
+
+def render_preview(fontdict, text, font, filename, scale, tracking):
+    """Write a string as a PNG, set the way blitstr lays out a line: each glyph w pixels wide plus tracking,
+    yOffset pixels below the top of the line. Characters come from the named font or the first one that has them."""
+    fonts = [k for k in fontdict.keys() if font is None or k == font]
+    records = OrderedDict([])
+    for k in fonts:
+        records[k] = glyph_records(outputs['fonts/{}.rs'.format(k)])
+    lines = []
+    used = set()
+    for line in text.split('\n'):
+        glyphs = [] # (w, h, yOffset, rows)
+        for ch in line:
+            key = '{:x}'.format(ord(ch))
+            found = [k for k in fonts if key in records[k]]
+            if len(found) == 0:
+                event('warning', "U+{:04X} is not in {}, left out of the preview".format(ord(ch), 'any font' if font is None else font),
+                    codepoint=ord(ch), font=font)
+                continue
+            used.add(found[0])
+            words = records[found[0]][key]
+            header = int(words[0], 16)
+            glyphs.append(((header >> 16) & 0xff, (header >> 8) & 0xff, header & 0xff, glyph_bitmap(words)))
+        lines.append(glyphs)
+    # one line height for the whole preview: the deepest glyph of any font the text was drawn from
+    height = 0
+    for k in used:
+        for words in records[k].values():
+            header = int(words[0], 16)
+            height = max(height, (header & 0xff) + ((header >> 8) & 0xff))
+    width = max([sum([g[0] + tracking for g in glyphs]) for glyphs in lines])
+    if width == 0 or height == 0:
+        event('error', "Nothing to draw for {!r}".format(text), text=text)
+        return 1
+    rows = []
+    for glyphs in lines:
+        canvas = [['.'] * width for y in range(height)]
+        x = 0
+        for w, h, yoffset, bitmap in glyphs:
+            for y, row in enumerate(bitmap):
+                if yoffset + y < height:
+                    canvas[yoffset + y][x:x + w] = list(row)
+            x = x + w + tracking
+        rows += [''.join(row) for row in canvas]
+    write_png(filename, rows, scale)
+    event('file_written', "Wrote {} line(s) of text at {}x to {}".format(len(lines), scale, filename),
+        file=filename, fonts=sorted(used), scale=scale)
+    return 0
+
+def parse_codepoints(args):
+    """Accept any mix of single codepoints and inclusive ranges such as U+4E00..U+4E20."""
+    cps = []
+    for arg in args:
+        if '..' in arg and len(arg) > 2:
+            first, last = arg.split('..', 1)
+            start, end = parse_codepoint(first), parse_codepoint(last)
+            if end < start:
+                raise CodepointError("'{}' is not a range; put the lower codepoint first, as in U+4E00..U+4E20".format(arg))
+            cps += range(start, end + 1)
+        else:
+            cps.append(parse_codepoint(arg))
+    return cps
+
+def report_lookup(fontdict, offsetdict, args):
+    """Show which fonts contain some codepoints, where their records sit, and what they look like."""
+    cps = parse_codepoints(args)
+    found = set()
+    for k in fontdict.keys():
+        records = glyph_records(outputs['fonts/{}.rs'.format(k)])
+        index = 0
+        indices = {}
+        for key, words in records.items():
+            indices[key] = index
+            index = index + len(words)
+        for cp in cps:
+            key = '{:x}'.format(cp)
+            if key not in records:
+                continue
+            found.add(cp)
+            words = records[key]
+            header = int(words[0], 16)
+            w, h, yoffset = (header >> 16) & 0xff, (header >> 8) & 0xff, header & 0xff
+            rows = glyph_bitmap(words)
+            event('glyph', "U+{:04X} in {}: DATA_{}[{}], {} words, FLASH offset 0x{:08x}\n  w={} h={} yOffset={}{}".format(
+                cp, k, k.upper(), indices[key], len(words), offsetdict[k] + indices[key] * 4,
+                w, h, yoffset, ''.join(["\n  " + row for row in rows])),
+                level='result', codepoint=cp, font=k, index=indices[key], words=len(words), offset=offsetdict[k] + indices[key] * 4,
+                w=w, h=h, y_offset=yoffset, rows=rows)
+    if len(cps) == 1 and len(found) == 0:
+        event('not_found', "U+{:04X} is not in any font".format(cps[0]), level='warning', codepoint=cps[0])
+    elif len(cps) > 1:
+        event('lookup_summary', "{} of {} codepoints found".format(len(found), len(cps)),
+            level='result', found=len(found), requested=len(cps))
+
+def dump_glyphs(fontdict, dirname):
+    """Write every glyph of every font as ASCII art, one text file per font, for reviewing font changes."""
+    os.makedirs(dirname, exist_ok=True)
+    for k in fontdict.keys():
+        filename = os.path.join(dirname, k + '.txt')
+        with open(filename, 'w') as dumpfile:
+            for key, words in glyph_records(outputs['fonts/{}.rs'.format(k)]).items():
+                header = int(words[0], 16)
+                dumpfile.write("{} w={} h={} yOffset={}\n".format(record_name(key),
+                    (header >> 16) & 0xff, (header >> 8) & 0xff, header & 0xff))
+                for row in glyph_bitmap(words):
+                    dumpfile.write(row + "\n")
+                dumpfile.write("\n")
+        event('file_written', "Wrote " + filename, file=filename)
+
+def write_metrics(fontdict, offsetdict, dirname):
+    """Write one <font>.json per font with each glyph's metrics and position, for host-side layout and size tools."""
+    os.makedirs(dirname, exist_ok=True)
+    for k,v in fontdict.items():
+        records = glyph_records(outputs['fonts/{}.rs'.format(k)])
+        glyphs = []
+        index = 0
+        for key, words in records.items():
+            header = int(words[0], 16)
+            glyphs.append(OrderedDict([('codepoints', [int(cp, 16) for cp in key.split('-')]), ('w', (header >> 16) & 0xff), ('h', (header >> 8) & 0xff),
+                ('y_offset', header & 0xff), ('offset', index * 4), ('len', len(words) * 4)]))
+            index = index + len(words)
+        metrics = OrderedDict([
+            ('name', k),
+            ('offset', offsetdict[k]),
+            ('len', int(v) * 4),
+            ('glyph_count', len(glyphs)),
+            ('max_height', max([g['h'] for g in glyphs]) if len(glyphs) > 0 else 0),
+            ('glyphs', glyphs),
+        ])
+        filename = os.path.join(dirname, k + '.json')
+        with open(filename, 'w') as jsonfile:
+            json.dump(metrics, jsonfile, indent=2)
+            jsonfile.write("\n")
+        event('file_written', "Wrote " + filename, file=filename)
+
+def verify_dump(fontdict, offsetdict, region, filename):
+    """Compare a dump of a device's font region word-for-word against the data generated in this run."""
+    with open(filename, 'rb') as dumpfile:
+        dump = dumpfile.read()
+    if len(dump) >= IMAGE_HEADER_LEN and struct.unpack('<I', dump[:4])[0] == IMAGE_MAGIC:
+        dump = dump[struct.unpack('<I', dump[8:12])[0]:] # skip an --image-header header
+    if len(dump) < len(region):
+        event('warning', "{} is {} bytes, shorter than the {} byte font region".format(filename, len(dump), len(region)),
+            file=filename, bytes=len(dump), expected=len(region))
+    bad = False
+    for k,v in fontdict.items():
+        base = offsetdict[k]
+        mismatched = OrderedDict([])
+        index = 0
+        for key, words in glyph_records(outputs['fonts/{}.rs'.format(k)]).items():
+            for word in range(index, index + len(words)):
+                start = base + word * 4
+                if dump[start:start + 4] != region[start:start + 4]:
+                    mismatched[key] = mismatched.get(key, 0) + 1
+            index = index + len(words)
+        if len(mismatched) == 0:
+            event('verify_ok', "{}: ok".format(k), level='result', font=k)
+            continue
+        bad = True
+        shown = ' '.join(['{}({})'.format(record_name(key), n) for key, n in list(mismatched.items())[:16]])
+        event('verify_mismatch', "{}: {} words differ in {} glyphs: {}{}".format(k, sum(mismatched.values()), len(mismatched),
+            shown, ' ...' if len(mismatched) > 16 else ''), level='error',
+            font=k, words=sum(mismatched.values()), glyphs=OrderedDict([(record_name(key), n) for key, n in mismatched.items()]))
+    return 1 if bad else 0
+
+def read_existing(filename):
+    try:
+        with open(destination(filename)) as infile:
+            return infile.read()
+    except OSError:
+        return ''
+
+# the recorded blitstr revision, in each form it is written: a comment, an Option<&str> and a JSON string or null
+REVISION = re.compile(r'(blitstr revision |FONT_SOURCE_REV: Option<&str> = |"source_rev": )(Some\("[^"]*"\)|"[^"]*"|[^ ;,\n]*)')
+
+def without_revision(text):
+    """Blank out the recorded blitstr revision, which differs between checkouts of identical sources,
+    and is not known at all outside a git checkout."""
+    return REVISION.sub(r'\1', text)
+
+def print_diffs():
+    """Print unified diffs between the files generated in this run and the ones on disk."""
+    for filename, contents in outputs.items():
+        name = os.path.normpath(os.path.join('loader/src', filename)) # relative to the root of xous-core
+        diff = ''.join(difflib.unified_diff(read_existing(filename).splitlines(True), contents.splitlines(True),
+            fromfile='a/' + name, tofile='b/' + name))
+        if log_format == 'json':
+            if len(diff) > 0:
+                event('file_diff', diff, level='result', file=name)
+        else:
+            sys.stdout.write(diff)
+
+def report_diff(fontdict, offsetdict, crcdict, region):
+    """Compare the fonts generated in this run against the ones on disk, without writing anything."""
+    try:
+        with open(destination(FONTMAP_JSON)) as jsonfile:
+            oldmap = json.load(jsonfile)
+        old = OrderedDict([(f['name'], f) for f in oldmap['fonts']])
+        old_total = oldmap['font_total_len']
+    except (OSError, ValueError, KeyError):
+        event('warning', "No readable {}, treating every font as new".format(FONTMAP_JSON), file=FONTMAP_JSON)
+        old = OrderedDict([])
+        old_total = 0
+    changed = False
+    for k,v in fontdict.items():
+        length = int(v) * 4
+        if k not in old:
+            event('font_added', "{}: added, {} bytes".format(k, length), level='result', font=k, bytes=length)
+            changed = True
+            continue
+        if old[k]['crc32'] == crcdict[k] and old[k]['len'] == length:
+            continue
+        changed = True
+        message = "{}: {} -> {} bytes ({:+d})".format(k, old[k]['len'], length, length - old[k]['len'])
+        glyphs = OrderedDict([])
+        try:
+            with open(destination('fonts/{}.rs'.format(k))) as oldfile:
+                before = glyph_records(oldfile.read())
+        except OSError:
+            before = None
+        if before is not None:
+            after = glyph_records(outputs['fonts/{}.rs'.format(k)])
+            for label, keys in [
+                ('added', [key for key in after if key not in before]),
+                ('removed', [key for key in before if key not in after]),
+                ('changed', [key for key in after if key in before and after[key] != before[key]]),
+            ]:
+                if len(keys) > 0:
+                    shown = ' '.join([record_name(key) for key in keys[:16]])
+                    message += "\n  {} {} glyphs: {}{}".format(label, len(keys), shown, ' ...' if len(keys) > 16 else '')
+                    glyphs[label] = [record_name(key) for key in keys]
+        event('font_changed', message, level='result', font=k, old_bytes=old[k]['len'], bytes=length, glyphs=glyphs)
+    for k in old.keys():
+        if k not in fontdict:
+            event('font_removed', "{}: removed, {} bytes".format(k, old[k]['len']), level='result', font=k, bytes=old[k]['len'])
+            changed = True
+    if changed:
+        event('diff_summary', "Font region: {} bytes ({:+d})".format(len(region), len(region) - old_total),
+            level='result', changed=True, bytes=len(region), old_bytes=old_total)
+    else:
+        event('diff_summary', "No font data changes", level='result', changed=False, bytes=len(region), old_bytes=old_total)
+
+# (first, last, name) of the Unicode blocks the blitstr fonts draw from; --stats counts anything else as "other"
+UNICODE_BLOCKS = [
+    (0x0000, 0x007f, "Basic Latin"),
+    (0x0080, 0x00ff, "Latin-1 Supplement"),
+    (0x0100, 0x017f, "Latin Extended-A"),
+    (0x0180, 0x024f, "Latin Extended-B"),
+    (0x2000, 0x206f, "General Punctuation"),
+    (0x2070, 0x209f, "Superscripts and Subscripts"),
+    (0x20a0, 0x20cf, "Currency Symbols"),
+    (0x2100, 0x214f, "Letterlike Symbols"),
+    (0x2150, 0x218f, "Number Forms"),
+    (0x2190, 0x21ff, "Arrows"),
+    (0x2200, 0x22ff, "Mathematical Operators"),
+    (0x2300, 0x23ff, "Miscellaneous Technical"),
+    (0x2400, 0x243f, "Control Pictures"),
+    (0x2460, 0x24ff, "Enclosed Alphanumerics"),
+    (0x2500, 0x257f, "Box Drawing"),
+    (0x2580, 0x259f, "Block Elements"),
+    (0x25a0, 0x25ff, "Geometric Shapes"),
+    (0x2600, 0x26ff, "Miscellaneous Symbols"),
+    (0x2700, 0x27bf, "Dingbats"),
+    (0x2900, 0x297f, "Supplemental Arrows-B"),
+    (0x2b00, 0x2bff, "Miscellaneous Symbols and Arrows"),
+    (0x3000, 0x303f, "CJK Symbols and Punctuation"),
+    (0x3040, 0x309f, "Hiragana"),
+    (0x30a0, 0x30ff, "Katakana"),
+    (0x3200, 0x32ff, "Enclosed CJK Letters and Months"),
+    (0x3400, 0x4dbf, "CJK Unified Ideographs Extension A"),
+    (0x4e00, 0x9fff, "CJK Unified Ideographs"),
+    (0xe000, 0xf8ff, "Private Use Area"),
+    (0xff00, 0xffef, "Halfwidth and Fullwidth Forms"),
+    (0xfff0, 0xffff, "Specials"),
+    (0x1f000, 0x1f02f, "Mahjong Tiles"),
+    (0x1f0a0, 0x1f0ff, "Playing Cards"),
+    (0x1f100, 0x1f1ff, "Enclosed Alphanumeric Supplement"),
+    (0x1f200, 0x1f2ff, "Enclosed Ideographic Supplement"),
+    (0x1f300, 0x1f5ff, "Miscellaneous Symbols and Pictographs"),
+    (0x1f600, 0x1f64f, "Emoticons"),
+    (0x1f680, 0x1f6ff, "Transport and Map Symbols"),
+    (0x1f780, 0x1f7ff, "Geometric Shapes Extended"),
+    (0x1f900, 0x1f9ff, "Supplemental Symbols and Pictographs"),
+    (0x1fa70, 0x1faff, "Symbols and Pictographs Extended-A"),
+    (0x20000, 0x2a6df, "CJK Unified Ideographs Extension B"),
+    (0x2a700, 0x2b73f, "CJK Unified Ideographs Extension C"),
+    (0x2b740, 0x2b81f, "CJK Unified Ideographs Extension D"),
+    (0x2b820, 0x2ceaf, "CJK Unified Ideographs Extension E"),
+]
+
+def unicode_block(cp):
+    for first, last, name in UNICODE_BLOCKS:
+        if first <= cp <= last:
+            return name
+    return "other"
+
+def report_stats(fontdict, offsetdict, font_base, region, jsonname):
+    """Summarize glyph counts, sizes, widths and FLASH usage of the fonts generated in this run."""
+    stats = OrderedDict([])
+    for k,v in fontdict.items():
+        records = glyph_records(outputs['fonts/{}.rs'.format(k)])
+        widths = OrderedDict([])
+        for words in records.values():
+            w = (int(words[0], 16) >> 16) & 0xff
+            widths[w] = widths.get(w, 0) + 1
+        cps = [int(key.split('-')[0], 16) for key in records.keys()] # a sequence counts under its first codepoint
+        blocks = OrderedDict([(name, 0) for first, last, name in UNICODE_BLOCKS] + [("other", 0)])
+        for cp in cps:
+            blocks[unicode_block(cp)] += 1
+        cumulative = offsetdict[k] + int(v) * 4 # including any alignment padding
+        stats[k] = OrderedDict([
+            ('glyphs', len(records)),
+            ('bytes', int(v) * 4),
+            ('cumulative_bytes', cumulative),
+            ('first_codepoint', min(cps) if len(cps) > 0 else None),
+            ('last_codepoint', max(cps) if len(cps) > 0 else None),
+            ('widths', OrderedDict([(str(w), widths[w]) for w in sorted(widths.keys())])),
+            ('blocks', OrderedDict([(name, n) for name, n in blocks.items() if n > 0])),
+        ])
+        span = "U+{:04X}..U+{:04X}".format(min(cps), max(cps)) if len(cps) > 0 else "no glyphs"
+        event('font_stats', "{}: {} glyphs, {} bytes, {}, cumulative {} bytes\n  widths: {}\n  blocks: {}".format(
+            k, len(records), int(v) * 4, span, cumulative,
+            ' '.join(["{}px x{}".format(w, n) for w, n in stats[k]['widths'].items()]),
+            ', '.join(["{} x{}".format(name, n) for name, n in stats[k]['blocks'].items()])), level='result', font=k, **stats[k])
+    budget = FONT_LIMIT - font_base
+    event('region_stats', "Font region: {} of {} bytes used ({:.1f}%), {} bytes free".format(
+        len(region), budget, 100.0 * len(region) / budget, budget - len(region)),
+        level='result', bytes=len(region), budget_bytes=budget)
+    if jsonname is not None:
+        with open(jsonname, 'w') as jsonfile:
+            json.dump(OrderedDict([('fonts', stats), ('total_bytes', len(region)), ('budget_bytes', budget)]), jsonfile, indent=2)
+            jsonfile.write("\n")
+
+SELFTEST_FONTS = {
+    'alpha.rs': """/// Packed glyph pattern data.
+pub const DATA: [u32; 4] = [
+    // [0]: 21 "!"
+    0x00020e06, 0xfffff0f0,
+    // [2]: 2d "-"
+    0x00040100, 0xf0000000,
+];
+""",
+    'beta.rs': """/// Packed glyph pattern data.
+pub const DATA: [u32; 2] = [
+    // [0]: 41 "A"
+    0x00030300, 0xaa800000,
+];
+""",
+}
+
+# golden vectors for SELFTEST_FONTS: (generator arguments, file, lines that file must contain)
+SELFTEST_VECTORS = [
+    ([], 'services/graphics-server/src/fontmap.rs', [
+        "// Generated from blitstr revision unknown with --align 4",
+        "pub const FONT_SOURCE_REV: Option<&str> = None;",
+        "pub const FONT_SOURCE_SHA256: &str = \"3bee963ad5704b3aa70074922e8287b77a44103e728bee5d422501b1dd5c2b13\";",
+        "pub const ALPHA_OFFSET: usize = 0x00000000;",
+        "pub const ALPHA_LEN: usize = 0x00000010;",
+        "pub const ALPHA_CRC32: u32 = 0x562a17f0;",
+        "pub const BETA_OFFSET: usize = 0x00000010;",
+        "pub const BETA_LEN: usize = 0x00000008;",
+        "pub const BETA_CRC32: u32 = 0xdfde65e7;",
+        "pub const FONT_TOTAL_LEN: usize = 0x00000018;",
+        "pub const FONT_TOTAL_CRC32: u32 = 0x93a8cfd6;",
+        "pub const FONT_BUILD_ID: u32 = 0x3bee963a;",
+        "pub const FONT_IMAGE_HEADER_LEN: usize = 28;",
+        "    FontInfo { name: \"alpha\", offset: ALPHA_OFFSET, len: ALPHA_LEN, glyph_count: 2, max_height: 14, proportional: true },",
+        "    FontInfo { name: \"beta\", offset: BETA_OFFSET, len: BETA_LEN, glyph_count: 1, max_height: 3, proportional: false },",
+    ]),
+    ([], 'loader/src/fonts/alpha.rs', [
+        "pub static DATA_ALPHA: super::FontData<[u32; 4]> = super::FontData([",
+        "]);",
+        "pub const CRC32_ALPHA: u32 = 0x562a17f0;",
+    ]),
+    ([], 'loader/src/fonts.rs', ["pub mod alpha;", "pub mod beta;", "#[repr(C, align(4))]"]),
+    ([], 'loader/fonts.x', ["_font_base = 0x20520000;", "_font_total_len = 0x00000018;"]),
+    ([], 'image.hex', [
+        ":02000004205288",
+        ":10000000060E0200F0F0FFFF00010400000000F007",
+        ":0800100000030300000080AAB8",
+        ":00000001FF",
+    ]),
+    (['-a', '64'], 'services/graphics-server/src/fontmap.rs', [
+        "pub const FONT_ALIGN: usize = 64;",
+        "pub const BETA_OFFSET: usize = 0x00000040;",
+        "pub const FONT_TOTAL_LEN: usize = 0x00000080;",
+    ]),
+]
+
+def selftest(parser):
+    """Run the whole pipeline over SELFTEST_FONTS and compare the results against golden vectors."""
+    global out_dir, log_level
+    failures = 0
+    if glyph_bitmap(['0x00030300', '0xaa800000']) != ['#.#', '.#.', '#.#']:
+        event('error', "selftest: glyph_bitmap does not unpack a 3x3 glyph correctly")
+        failures = failures + 1
+    if glyph_bitmap(['0x00020200', '0xa0000000']) != ['.#', '.#']:
+        event('error', "selftest: glyph_bitmap does not unpack the rows of a glyph right to left")
+        failures = failures + 1
+    records = glyph_records('    // [0]: 1f1e6-1f1e8 "\U0001f1e6\U0001f1e8"\n    0x00010100, 0x80000000,\n'
+        '    // [2]: 1f1e6 "\U0001f1e6"\n    0x00010100, 0x00000000,\n')
+    if list(records.keys()) != ['1f1e6-1f1e8', '1f1e6'] or records['1f1e6'] != ['0x00010100', '0x00000000']:
+        event('error', "selftest: glyph_records does not keep an emoji sequence apart from its first codepoint")
+        failures = failures + 1
+    if without_revision('FONT_SOURCE_REV: Option<&str> = Some("v0.1-dirty");') != without_revision('FONT_SOURCE_REV: Option<&str> = None;'):
+        event('error', "selftest: --check would depend on whether the blitstr revision is known")
+        failures = failures + 1
+    with tempfile.TemporaryDirectory() as tmp:
+        os.makedirs(os.path.join(tmp, 'src', 'fonts'))
+        for name, text in SELFTEST_FONTS.items():
+            with open(os.path.join(tmp, 'src', 'fonts', name), 'w') as fixture:
+                fixture.write(text)
+        generated = {} # one run per distinct set of generator arguments
+        saved_level = log_level
+        for extra, filename, expected in SELFTEST_VECTORS:
+            out = os.path.join(tmp, 'out' + ''.join(extra))
+            if out not in generated:
+                out_dir = out
+                outputs.clear()
+                if log_level != 'debug':
+                    log_level = 'warning'
+                args = parser.parse_args(['-d', tmp, '-i', os.path.join(out, 'image.hex')] + extra)
+                generated[out] = generate(args)
+                log_level = saved_level
+            if generated[out] != 0:
+                event('error', "selftest: generation with {} failed".format(extra))
+                failures = failures + 1
+                continue
+            with open(os.path.join(out, filename)) as result:
+                lines = result.read().splitlines()
+            for line in expected:
+                if line not in lines:
+                    event('error', "selftest: {} with {} is missing '{}'".format(filename, extra, line))
+                    failures = failures + 1
+        out_dir = None
+    if failures > 0:
+        event('error', "selftest: {} failures".format(failures))
+        return 1
+    event('selftest_passed', "selftest: all {} vectors passed".format(len(SELFTEST_VECTORS) + 4), level='result')
+    return 0
+
 def main():
     parser = argparse.ArgumentParser(description="Build the Betrusted SoC")
     parser.add_argument(
         "-d", "--dir", default="../../../blitstr", help="Location of the blitstr source files", type=str
     )
+    parser.add_argument(
+        "-o", "--out-dir", help="Write the generated files under this directory, laid out as in the xous-core tree, instead of in place", type=str
+    )
+    # at most one of these; each replaces the normal run of writing out the generated files
+    modes = parser.add_mutually_exclusive_group()
+    parser.add_argument(
+        "-i", "--image", help="Also write a flashable image of the font region, positioned at FONT_BASE. Files ending in .hex are written as Intel HEX, anything else as raw binary", type=str
+    )
+    parser.add_argument(
+        "--image-header", help="Prepend a versioned header and font directory to the image. The glyph data then no longer starts at FONT_BASE, so this is meant for update payloads rather than flashing in place", action="store_true"
+    )
+    modes.add_argument(
+        "--dry-run", help="Print unified diffs of the generated files against the ones on disk instead of writing them", action="store_true"
+    )
+    modes.add_argument(
+        "--check", help="Regenerate without writing and exit non-zero if any generated file on disk is out of date", action="store_true"
+    )
+    parser.add_argument(
+        "--dump-dir", help="Also write every glyph as ASCII art into one <font>.txt file per font in this directory", type=str
+    )
+    parser.add_argument(
+        "--metrics-dir", help="Also write the codepoint, size and position of every glyph into one <font>.json file per font in this directory", type=str
+    )
+    modes.add_argument(
+        "--diff", help="Report which fonts and glyphs would change, and by how much, without writing any files", action="store_true"
+    )
+    modes.add_argument(
+        "--stats", help="Report glyph counts, sizes, widths and FLASH usage per font without writing any files", action="store_true"
+    )
+    parser.add_argument(
+        "--stats-json", help="With --stats, also write the report as JSON to this file", type=str
+    )
+    modes.add_argument(
+        "--lookup", action="append", help="Trace a codepoint (U+4E2D, 0x4e2d or the character itself) or a range (U+4E00..U+4E20) through the generated fonts without writing any files. May be repeated", type=str
+    )
+    modes.add_argument(
+        "--extract", help="Write the glyph for a codepoint (same forms as --lookup) to a PNG without writing any other files", type=str
+    )
+    parser.add_argument(
+        "--extract-font", help="With --extract, take the glyph from this font instead of the first one that has it", type=str
+    )
+    parser.add_argument(
+        "--extract-png", help="With --extract, the PNG file to write (default U+XXXX_font.png)", type=str
+    )
+    parser.add_argument(
+        "--scale", default=1, help="With --extract or --preview, scale the image up by this integer factor", type=int
+    )
+    modes.add_argument(
+        "--preview", help="Render this text (\\n starts a new line) to a PNG with the generated glyphs, without writing any other files", type=str
+    )
+    parser.add_argument(
+        "--preview-font", help="With --preview, draw only from this font instead of the first one that has each character", type=str
+    )
+    parser.add_argument(
+        "--preview-tracking", default=2, help="With --preview, blank pixels between glyphs", type=int
+    )
+    parser.add_argument(
+        "--preview-png", default="preview.png", help="With --preview, the PNG file to write", type=str
+    )
+    modes.add_argument(
+        "--verify", help="Compare a binary dump of the FLASH font region against the generated data, without writing any files. Exits non-zero on a mismatch", type=str
+    )
+    modes.add_argument(
+        "--watch", help="Keep running, and regenerate whenever a font file in the blitstr checkout changes", action="store_true"
+    )
+    parser.add_argument(
+        "--watch-interval", default=1.0, help="With --watch, seconds between checks for changes", type=float
+    )
+    parser.add_argument(
+        "--log-format", default="text", choices=["text", "json"], help="Report progress as plain text, or as one JSON object per line for CI and xtask", type=str
+    )
+    parser.add_argument(
+        "--log-level", default="info", choices=LOG_LEVELS, help="Only report events at this level or more severe. The output of --diff, --stats, --lookup, --verify and --bench is always shown", type=str
+    )
+    parser.add_argument(
+        "-q", "--quiet", help="Same as --log-level warning", action="store_true"
+    )
+    parser.add_argument(
+        "-v", "--verbose", help="Same as --log-level debug", action="store_true"
+    )
+    modes.add_argument(
+        "--selftest", help="Run the generator over small built-in fonts and check the results against golden vectors, without touching the tree", action="store_true"
+    )
+    parser.add_argument(
+        "--bench", help="Report the time spent in each stage of generation", action="store_true"
+    )
+    parser.add_argument(
+        "-a", "--align", default=4, help="Alignment in bytes of each font's data in FLASH (a power of two, at least 4)", type=int
+    )
     args = parser.parse_args()
+    global log_format, log_level, out_dir
+    log_format = args.log_format
+    log_level = args.log_level
+    if args.quiet:
+        log_level = 'warning'
+    if args.verbose:
+        log_level = 'debug'
+    if args.align < 4 or (args.align & (args.align - 1)) != 0:
+        event('error', "--align must be a power of two of at least 4", align=args.align)
+        return 1
+    report = [option for option, given in [('--dry-run', args.dry_run), ('--check', args.check), ('--diff', args.diff),
+        ('--stats', args.stats), ('--lookup', args.lookup is not None), ('--extract', args.extract is not None),
+        ('--preview', args.preview is not None), ('--verify', args.verify is not None)] if given]
+    written = [option for option, given in [('--image', args.image is not None), ('--image-header', args.image_header),
+        ('--dump-dir', args.dump_dir is not None), ('--metrics-dir', args.metrics_dir is not None)] if given]
+    if len(report) > 0 and len(written) > 0:
+        event('error', "{} does not write any files, so it cannot be combined with {}".format(report[0], ', '.join(written)),
+            mode=report[0], options=written)
+        return 1
+    if args.preview_tracking < 0:
+        event('error', "--preview-tracking cannot be negative", tracking=args.preview_tracking)
+        return 1
+    if args.scale < 1:
+        event('error', "--scale must be at least 1", scale=args.scale)
+        return 1
+    out_dir = args.out_dir
+    try:
+        if args.selftest:
+            return selftest(parser)
+        if args.watch:
+            return watch(args)
+        return generate(args)
+    except (FontError, OSError) as e:
+        report_error(e)
+        return 2
+    except CodepointError as e:
+        event('error', str(e))
+        return 2
+
+def report_error(e):
+    if isinstance(e, FontError):
+        event('error', str(e), file=e.filename, line=e.lineno)
+    else:
+        event('error', "{}: {}".format(e.filename, e.strerror), file=e.filename)
+
+def source_mtimes(args):
+    try:
+        with os.scandir(args.dir + '/src/fonts') as listOfEntries:
+            return dict([(entry.name, entry.stat().st_mtime) for entry in listOfEntries if entry.is_file()])
+    except OSError:
+        return None # e.g. the directory is being replaced; treated as a change once it is back
+
+def watch(args):
+    """Regenerate whenever a font source in the blitstr checkout changes, until interrupted."""
+    try:
+        while True:
+            outputs.clear()
+            try:
+                generate(args)
+            except (FontError, OSError) as e:
+                # a half-saved source is normal while someone is editing it; wait for the next change
+                report_error(e)
+            event('watching', "Watching {} for changes, ^C to stop".format(args.dir + '/src/fonts'), dir=args.dir + '/src/fonts')
+            mtimes = source_mtimes(args)
+            while source_mtimes(args) == mtimes:
+                time.sleep(args.watch_interval)
+    except KeyboardInterrupt:
+        return 0
 
+def source_revision(dirname):
+    """The git revision of a blitstr checkout, or None if dirname is not the top of a git repository
+    (so that a parent repository's revision is never recorded by mistake)."""
+    try:
+        top = subprocess.check_output(['git', '-C', dirname, 'rev-parse', '--show-toplevel'],
+            stderr=subprocess.DEVNULL).decode().strip()
+        if os.path.realpath(top) != os.path.realpath(dirname):
+            return None
+        return subprocess.check_output(['git', '-C', dirname, 'describe', '--always', '--dirty'],
+            stderr=subprocess.DEVNULL).decode().strip()
+    except (subprocess.CalledProcessError, OSError):
+        return None
+
+def rust_option(text):
+    return 'Some("{}")'.format(text) if text is not None else 'None'
+
+def generate(args):
     fontdir = args.dir + '/src/fonts'
+    if not os.path.isdir(fontdir):
+        raise FontError(fontdir, "not a directory; point -d/--dir at a blitstr checkout")
+    # record where the fonts came from, so a device's font data can be traced back to its inputs.
+    # The source hash and parameters are always known; the revision only for a real blitstr checkout.
+    source_rev = source_revision(args.dir)
+    source_hash = hashlib.sha256() # over the copied source text, in link order
+    provenance = "// Generated from blitstr revision {} with --align {}\n".format(
+        source_rev if source_rev is not None else 'unknown', args.align)
+    font_base = 0x20520000
     fontdict = OrderedDict([]) # we want a deterministic dict
+    offsetdict = OrderedDict([])
+    crcdict = OrderedDict([])
+    region = bytearray() # the font region as it is laid out in FLASH, fonts are visited in link order
+    timings = OrderedDict([]) # stage -> seconds, for --bench
+    last = [time.perf_counter()]
+    def mark(stage):
+        now = time.perf_counter()
+        timings[stage] = timings.get(stage, 0.0) + now - last[0]
+        last[0] = now
     filter = re.compile('.*DATA.*u32.*[0-9]*.*')
     with os.scandir(fontdir) as listOfEntries:
-        for entry in listOfEntries:
+        # scandir order depends on the filesystem; sort so that reruns reproduce the same link order
+        for entry in sorted(listOfEntries, key=lambda e: e.name):
             if entry.is_file():
-                print("Processing " + entry.name)
+                event('font_started', "Processing " + entry.name, file=entry.name)
                 modulename = entry.name.split('.')[0]
-                with open(entry) as infile, open('fonts/' + entry.name, 'w') as outfile:
+                with open(entry, 'rb') as sourcefile:
+                    source = sourcefile.read()
+                try:
+                    infile = io.StringIO(source.decode('utf-8'), newline=None)
+                except UnicodeDecodeError as e:
+                    raise FontError(entry.path, "not valid UTF-8 ({})".format(e.reason), source.count(b'\n', 0, e.start) + 1)
+                with output('fonts/' + entry.name) as outfile:
                     outfile.write(
                         "// This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit.\n")
+                    outfile.write(provenance)
                     outfile.write("#[allow(dead_code)]\n")
                     outfile.write("#[link_section=\".fontdata\"]\n")
                     outfile.write("#[no_mangle]\n")
                     outfile.write("#[used]\n")
                     copy = False
-                    for line in infile:
+                    crc = 0
+                    words = 0
+                    decl_lineno = None
+                    offsetdict[modulename] = len(region)
+                    for lineno, line in enumerate(infile, 1):
                         if line.strip() == "/// Packed glyph pattern data.":
                             copy = True
                         if copy:
+                            source_hash.update(line.encode('utf-8'))
                             fixup = line.replace('pub const', 'pub static')
                             matched = filter.match(fixup)
                             if matched:
-                                arraylen = re.findall('\d+', matched.group().split(';')[1])[0]
+                                decl = matched.group().split(';')
+                                lengths = re.findall('\d+', decl[1]) if len(decl) > 1 else []
+                                if len(lengths) == 0:
+                                    raise FontError(entry.path, "DATA is declared without a length (expected [u32; N])", lineno)
+                                arraylen = lengths[0]
                                 fontdict[modulename] = arraylen
+                                decl_lineno = lineno
                                 fixup = fixup.replace('DATA', 'DATA_' + modulename.upper())
+                                fixup = fixup.replace('[u32; {}] = ['.format(arraylen),
+                                    'super::FontData<[u32; {}]> = super::FontData(['.format(arraylen))
+                            else:
+                                # checksum the words as they will sit in FLASH (little-endian)
+                                for word in WORD.findall(fixup.split('//')[0]):
+                                    packed = struct.pack('<I', int(word, 16))
+                                    crc = zlib.crc32(packed, crc)
+                                    region += packed
+                                    words = words + 1
+                            if line.strip() == "];":
+                                fixup = fixup.replace('];', ']);')
                             outfile.write(fixup)
                         if line.strip() == "];":
                             copy = False
-    print(fontdict)
-    with open('fonts.rs', 'w') as modfile:
+                    if modulename not in fontdict:
+                        raise FontError(entry.path, "no packed glyph DATA array found")
+                    if words != int(fontdict[modulename]):
+                        raise FontError(entry.path, "DATA is declared with {} words but {} were found".format(
+                            fontdict[modulename], words), decl_lineno)
+                    # the size of FontData<T> is a multiple of its alignment, so the linker pads every font out to it,
+                    # the last one included
+                    region += bytes(-len(region) % args.align)
+                    crcdict[modulename] = crc
+                    event('font_done', "  {}: {} words at offset 0x{:08x}, CRC32 0x{:08x}".format(
+                        modulename, fontdict[modulename], offsetdict[modulename], crc), level='debug',
+                        font=modulename, words=int(fontdict[modulename]), offset=offsetdict[modulename], crc32=crc)
+                    outfile.write("#[allow(dead_code)]\n")
+                    outfile.write("pub const CRC32_{}: u32 = 0x{:08x};\n".format(modulename.upper(), crc))
+                mark('read ' + modulename)
+    event('sizes', ', '.join(["{} {} bytes".format(k, int(v) * 4) for k,v in fontdict.items()]), level='debug',
+        fonts=OrderedDict([(k, int(v) * 4) for k,v in fontdict.items()]))
+    total_crc = zlib.crc32(region)
+    source_sha256 = source_hash.hexdigest()
+    build_id = struct.unpack('>I', source_hash.digest()[:4])[0] # identifies the sources even without a blitstr checkout
+    with output('fonts.rs') as modfile:
         modfile.write("// This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit.\n")
         modfile.write("// The order of these modules impacts the link order, which changes the position in the binary image.\n")
         for k,v in fontdict.items():
             modfile.write("pub mod {};\n".format(k))
+        modfile.write("\n/// Wrapper that places each font's data on a {}-byte boundary.\n".format(args.align))
+        modfile.write("#[repr(C, align({}))]\n".format(args.align))
+        modfile.write("pub struct FontData<T>(pub T);\n\n")
+        modfile.write("#[allow(dead_code)]\n")
+        modfile.write("pub const FONT_TOTAL_CRC32: u32 = 0x{:08x};\n".format(total_crc))
+        modfile.write(provenance)
+        modfile.write("#[allow(dead_code)]\n")
+        modfile.write("pub const FONT_SOURCE_REV: Option<&str> = {};\n".format(rust_option(source_rev)))
+        modfile.write("#[allow(dead_code)]\n")
+        modfile.write("pub const FONT_SOURCE_SHA256: &str = \"{}\";\n".format(source_sha256))
 
-    with open('../../services/graphics-server/src/fontmap.rs', 'w') as mapfile:
+    with output(FONTMAP_RS) as mapfile:
         mapfile.write("// This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit.\n")
         mapfile.write("// This makes probably bad assumptions about how link order is computed. Be suspicious of these offsets.\n")
         mapfile.write("#![allow(dead_code)]\n")
+        mapfile.write(provenance)
+        mapfile.write("pub const FONT_SOURCE_REV: Option<&str> = {};\n".format(rust_option(source_rev)))
+        mapfile.write("pub const FONT_SOURCE_SHA256: &str = \"{}\";\n".format(source_sha256))
         # Python iterators are deterministic, right......? so if I used the same iterator to make the link order it'll be the same here....right?
-        offset = 0
-        mapfile.write("pub const FONT_BASE: usize = 0x{:08x};\n".format(0x20520000))
+        mapfile.write("pub const FONT_BASE: usize = 0x{:08x};\n".format(font_base))
+        mapfile.write("pub const FONT_ALIGN: usize = {};\n".format(args.align))
+        mapfile.write("pub const FONT_LIMIT: usize = 0x{:08x}; // end of the FLASH reserved for fonts, see loader/link.x\n".format(FONT_LIMIT))
         for k,v in fontdict.items():
-            length = int(v) * 4
-            mapfile.write("pub const {}_OFFSET: usize = 0x{:08x};\n".format(k.upper(), offset))
-            mapfile.write("pub const {}_LEN: usize = 0x{:08x};\n".format(k.upper(), length))
-            offset = offset + length
-        mapfile.write("pub const FONT_TOTAL_LEN: usize = 0x{:08x};\n".format(offset))
+            mapfile.write("pub const {}_OFFSET: usize = 0x{:08x};\n".format(k.upper(), offsetdict[k]))
+            mapfile.write("pub const {}_LEN: usize = 0x{:08x};\n".format(k.upper(), int(v) * 4))
+            mapfile.write("pub const {}_CRC32: u32 = 0x{:08x};\n".format(k.upper(), crcdict[k]))
+        mapfile.write("pub const FONT_TOTAL_LEN: usize = 0x{:08x};\n".format(len(region)))
+        mapfile.write("pub const FONT_TOTAL_CRC32: u32 = 0x{:08x};\n".format(total_crc))
+        mapfile.write("pub const FONT_BUILD_ID: u32 = 0x{:08x};\n".format(build_id))
+        # a table of contents, so the graphics server can walk the fonts without naming each one
+        mapfile.write("#[derive(Clone, Copy, Debug)]\n")
+        mapfile.write("pub struct FontInfo {\n    pub name: &'static str,\n    pub offset: usize,\n    pub len: usize,\n")
+        mapfile.write("    pub glyph_count: usize,\n    pub max_height: usize,\n    pub proportional: bool,\n}\n")
+        mapfile.write("pub const FONT_TOC: [FontInfo; {}] = [\n".format(len(fontdict)))
+        for k in fontdict.keys():
+            headers = [int(words[0], 16) for words in glyph_records(outputs['fonts/{}.rs'.format(k)]).values()]
+            mapfile.write("    FontInfo {{ name: \"{}\", offset: {}_OFFSET, len: {}_LEN, glyph_count: {}, max_height: {}, proportional: {} }},\n".format(
+                k, k.upper(), k.upper(), len(headers), max([(h >> 8) & 0xff for h in headers] + [0]),
+                'true' if len(set([(h >> 16) & 0xff for h in headers])) > 1 else 'false'))
+        mapfile.write("];\n")
+        mapfile.write("// Header prepended to font images by `generate_fonts.py --image-header`. All fields are little-endian u32:\n")
+        mapfile.write("//   magic, version, header length (incl. directory), data length, data CRC32, font count,\n")
+        mapfile.write("//   build ID (FONT_BUILD_ID: the first four bytes of the SHA-256 of the font sources)\n")
+        mapfile.write("// followed by one directory entry per font: name (NUL-padded), offset from end of header, length, CRC32.\n")
+        mapfile.write("pub const FONT_IMAGE_MAGIC: u32 = 0x{:08x};\n".format(IMAGE_MAGIC))
+        mapfile.write("pub const FONT_IMAGE_VERSION: u32 = {};\n".format(IMAGE_VERSION))
+        mapfile.write("pub const FONT_IMAGE_HEADER_LEN: usize = {};\n".format(IMAGE_HEADER_LEN))
+        mapfile.write("pub const FONT_IMAGE_BUILD_ID_OFFSET: usize = {};\n".format(IMAGE_BUILD_ID_OFFSET))
+        mapfile.write("pub const FONT_IMAGE_NAME_LEN: usize = {};\n".format(IMAGE_NAME_LEN))
+        mapfile.write("pub const FONT_IMAGE_DIR_ENTRY_LEN: usize = {};\n".format(IMAGE_NAME_LEN + 12))
+        # check the map for consistency with `cargo test`, rather than finding out on hardware
+        mapfile.write("\n#[cfg(test)]\nmod tests {\n    use super::*;\n    #[test]\n    fn fontmap_is_contiguous() {\n")
+        prev = None
+        for k in fontdict.keys():
+            if prev is None:
+                mapfile.write("        assert_eq!({}_OFFSET, 0);\n".format(k.upper()))
+            else:
+                mapfile.write("        assert_eq!({}_OFFSET, (({}_OFFSET + {}_LEN + FONT_ALIGN - 1) / FONT_ALIGN) * FONT_ALIGN);\n".format(k.upper(), prev, prev))
+            mapfile.write("        assert_eq!({}_OFFSET % FONT_ALIGN, 0);\n".format(k.upper()))
+            mapfile.write("        assert_eq!({}_LEN % 4, 0);\n".format(k.upper()))
+            prev = k.upper()
+        if prev is not None:
+            mapfile.write("        assert_eq!(FONT_TOTAL_LEN, (({}_OFFSET + {}_LEN + FONT_ALIGN - 1) / FONT_ALIGN) * FONT_ALIGN);\n".format(prev, prev))
+        mapfile.write("        assert_eq!(FONT_BASE % FONT_ALIGN, 0);\n    }\n")
+        mapfile.write("    #[test]\n    fn fontmap_fits_in_flash() {\n")
+        mapfile.write("        assert!(FONT_BASE + FONT_TOTAL_LEN <= FONT_LIMIT);\n")
+        mapfile.write("        for font in FONT_TOC.iter() {\n            assert!(font.offset + font.len <= FONT_TOTAL_LEN);\n        }\n    }\n")
+        # fontmap.json is what xtask and the flashing scripts use, so it must agree with the constants
+        mapfile.write("    #[test]\n    fn fontmap_matches_json() {\n")
+        mapfile.write("        let json: String = include_str!(\"fontmap.json\").split_whitespace().collect();\n")
+        mapfile.write("        assert!(json.contains(&format!(\"\\\"font_base\\\":{},\", FONT_BASE)));\n")
+        mapfile.write("        assert!(json.contains(&format!(\"\\\"font_align\\\":{},\", FONT_ALIGN)));\n")
+        mapfile.write("        assert!(json.contains(&format!(\"\\\"font_total_len\\\":{},\", FONT_TOTAL_LEN)));\n")
+        mapfile.write("        assert!(json.contains(&format!(\"\\\"font_total_crc32\\\":{},\", FONT_TOTAL_CRC32)));\n")
+        for k in fontdict.keys():
+            mapfile.write("        assert!(json.contains(&format!(\"\\\"name\\\":\\\"{}\\\",\\\"offset\\\":{{}},\\\"len\\\":{{}},\\\"crc32\\\":{{}}\", {}_OFFSET, {}_LEN, {}_CRC32)));\n".format(
+                k, k.upper(), k.upper(), k.upper()))
+        mapfile.write("    }\n}\n")
+
+    # the same map in a form that xtask and flashing scripts can consume without parsing Rust
+    fontmap = OrderedDict([])
+    fontmap['source_rev'] = source_rev # null when the blitstr revision is not known
+    fontmap['source_sha256'] = source_sha256
+    fontmap['font_base'] = font_base
+    fontmap['font_align'] = args.align
+    fontmap['font_total_len'] = len(region)
+    fontmap['font_total_crc32'] = total_crc
+    fontmap['build_id'] = build_id
+    fontmap['fonts'] = []
+    for k,v in fontdict.items():
+        fontmap['fonts'].append(OrderedDict([('name', k), ('offset', offsetdict[k]), ('len', int(v) * 4), ('crc32', crcdict[k])]))
+    with output(FONTMAP_JSON) as jsonfile:
+        json.dump(fontmap, jsonfile, indent=2)
+        jsonfile.write("\n")
+
+    # linker script fragment, so link.x can check that the .fonts section matches the map above
+    with output('../fonts.x') as linkfile:
+        linkfile.write("/* This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit. */\n")
+        linkfile.write("/* {} */\n".format(provenance[3:-1]))
+        linkfile.write("_font_base = 0x{:08x};\n".format(font_base))
+        linkfile.write("_font_total_len = 0x{:08x};\n".format(len(region)))
+
+    mark('render maps')
+
+    if args.dry_run:
+        print_diffs()
+        return 0
+    if args.check:
+        stale = [filename for filename, contents in outputs.items()
+            if without_revision(read_existing(filename)) != without_revision(contents)]
+        for filename in stale:
+            name = os.path.normpath(os.path.join('loader/src', filename))
+            event('out_of_date', "{} is out of date".format(name), level='warning', file=name)
+        return 1 if len(stale) > 0 else 0
+    if args.diff:
+        report_diff(fontdict, offsetdict, crcdict, region)
+        return 0
+    if args.stats:
+        report_stats(fontdict, offsetdict, font_base, region, args.stats_json)
+        return 0
+    if args.lookup is not None:
+        report_lookup(fontdict, offsetdict, args.lookup)
+        return 0
+    if args.extract is not None:
+        return extract_glyph(fontdict, args.extract, args.extract_font, args.extract_png, args.scale)
+    if args.preview is not None:
+        if args.preview_font is not None and args.preview_font not in fontdict:
+            event('error', "Unknown font {}; available: {}".format(args.preview_font, ', '.join(fontdict.keys())),
+                unknown=[args.preview_font], available=list(fontdict.keys()))
+            return 1
+        return render_preview(fontdict, args.preview.replace('\\n', '\n'), args.preview_font, args.preview_png, args.scale,
+            args.preview_tracking)
+    if args.verify is not None:
+        return verify_dump(fontdict, offsetdict, region, args.verify)
+
+    for filename, contents in outputs.items():
+        if out_dir is not None:
+            os.makedirs(os.path.dirname(destination(filename)), exist_ok=True)
+        with open(destination(filename), 'w') as outfile:
+            outfile.write(contents)
+        event('file_written', "Wrote " + destination(filename), file=destination(filename), bytes=len(contents))
+    mark('write files')
+
+    if args.image is not None:
+        image = region
+        if args.image_header:
+            image = image_header(fontdict, offsetdict, crcdict, total_crc, len(region), build_id) + region
+        if args.image.endswith('.hex'):
+            write_ihex(args.image, font_base, image)
+        else:
+            with open(args.image, 'wb') as imagefile:
+                imagefile.write(image)
+        event('file_written', "Wrote {} bytes of font data for 0x{:08x} to {}".format(len(image), font_base, args.image),
+            file=args.image, bytes=len(image))
+        mark('write image')
+
+    if args.dump_dir is not None:
+        dump_glyphs(fontdict, args.dump_dir)
+        mark('dump glyphs')
+
+    if args.metrics_dir is not None:
+        write_metrics(fontdict, offsetdict, args.metrics_dir)
+        mark('write metrics')
+
+    if args.bench:
+        total = sum(timings.values())
+        for stage, seconds in timings.items():
+            event('bench', "{:>24}: {:8.3f} ms ({:4.1f}%)".format(stage, seconds * 1000, 100.0 * seconds / total if total > 0 else 0),
+                level='result', stage=stage, seconds=seconds)
+    return 0
 
 if __name__ == "__main__":
     from datetime import datetime
     start = datetime.now()
     ret = main()
-    print("Run completed in {}".format(datetime.now()-start))
+    event('completed', "Run completed in {}".format(datetime.now()-start), seconds=(datetime.now()-start).total_seconds(), status=ret)
 
     sys.exit(ret)
@@ -1232,14 +1232,14 @@ fn boot_sequence(args: KernelArguments, _signature: u32) -> ! {
     }
 
     println!("Font maps located as follows:");
-    println!("  Hanzi @ {:08x}", fonts::hanzi::DATA_HANZI.as_ptr() as u32);
-    println!("  Emoji @ {:08x}", fonts::emoji::DATA_EMOJI.as_ptr() as u32);
+    println!("  Hanzi @ {:08x}", fonts::hanzi::DATA_HANZI.0.as_ptr() as u32);
+    println!("  Emoji @ {:08x}", fonts::emoji::DATA_EMOJI.0.as_ptr() as u32);
     println!(
         "  Regular @ {:08x}",
-        fonts::regular::DATA_REGULAR.as_ptr() as u32
+        fonts::regular::DATA_REGULAR.0.as_ptr() as u32
     );
-    println!("  Small @ {:08x}", fonts::small::DATA_SMALL.as_ptr() as u32);
-    println!("  Bold @ {:08x}", fonts::bold::DATA_BOLD.as_ptr() as u32);
+    println!("  Small @ {:08x}", fonts::small::DATA_SMALL.0.as_ptr() as u32);
+    println!("  Bold @ {:08x}", fonts::bold::DATA_BOLD.0.as_ptr() as u32);
 
     if !clean {
         // The MMU should be set up now, and memory pages assigned to their
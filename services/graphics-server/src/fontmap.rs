@@ -1,15 +1,98 @@
 // This file is autogenerated by xous-core/loader/src/generate_fonts.py. Do not edit.
 // This makes probably bad assumptions about how link order is computed. Be suspicious of these offsets.
 #![allow(dead_code)]
+// Generated from blitstr revision unknown with --align 4
+pub const FONT_SOURCE_REV: Option<&str> = None;
+pub const FONT_SOURCE_SHA256: &str = "db362308fb6d40633a10c33860444deb7680a559f25a02f681f825d19c758154";
 pub const FONT_BASE: usize = 0x20520000;
+pub const FONT_ALIGN: usize = 4;
+pub const FONT_LIMIT: usize = 0x20980000; // end of the FLASH reserved for fonts, see loader/link.x
 pub const BOLD_OFFSET: usize = 0x00000000;
 pub const BOLD_LEN: usize = 0x00001774;
+pub const BOLD_CRC32: u32 = 0x5b3a083c;
 pub const EMOJI_OFFSET: usize = 0x00001774;
 pub const EMOJI_LEN: usize = 0x00059170;
+pub const EMOJI_CRC32: u32 = 0x89b9560c;
 pub const HANZI_OFFSET: usize = 0x0005a8e4;
 pub const HANZI_LEN: usize = 0x0010df64;
+pub const HANZI_CRC32: u32 = 0xe6099367;
 pub const REGULAR_OFFSET: usize = 0x00168848;
 pub const REGULAR_LEN: usize = 0x00001610;
+pub const REGULAR_CRC32: u32 = 0x48d20ac8;
 pub const SMALL_OFFSET: usize = 0x00169e58;
 pub const SMALL_LEN: usize = 0x000010bc;
+pub const SMALL_CRC32: u32 = 0xf10e15ad;
 pub const FONT_TOTAL_LEN: usize = 0x0016af14;
+pub const FONT_TOTAL_CRC32: u32 = 0xba6c4216;
+pub const FONT_BUILD_ID: u32 = 0xdb362308;
+#[derive(Clone, Copy, Debug)]
+pub struct FontInfo {
+    pub name: &'static str,
+    pub offset: usize,
+    pub len: usize,
+    pub glyph_count: usize,
+    pub max_height: usize,
+    pub proportional: bool,
+}
+pub const FONT_TOC: [FontInfo; 5] = [
+    FontInfo { name: "bold", offset: BOLD_OFFSET, len: BOLD_LEN, glyph_count: 206, max_height: 26, proportional: true },
+    FontInfo { name: "emoji", offset: EMOJI_OFFSET, len: EMOJI_LEN, glyph_count: 3360, max_height: 32, proportional: true },
+    FontInfo { name: "hanzi", offset: HANZI_OFFSET, len: HANZI_LEN, glyph_count: 8377, max_height: 32, proportional: false },
+    FontInfo { name: "regular", offset: REGULAR_OFFSET, len: REGULAR_LEN, glyph_count: 206, max_height: 26, proportional: true },
+    FontInfo { name: "small", offset: SMALL_OFFSET, len: SMALL_LEN, glyph_count: 206, max_height: 20, proportional: true },
+];
+// Header prepended to font images by `generate_fonts.py --image-header`. All fields are little-endian u32:
+//   magic, version, header length (incl. directory), data length, data CRC32, font count,
+//   build ID (FONT_BUILD_ID: the first four bytes of the SHA-256 of the font sources)
+// followed by one directory entry per font: name (NUL-padded), offset from end of header, length, CRC32.
+pub const FONT_IMAGE_MAGIC: u32 = 0x544e4658;
+pub const FONT_IMAGE_VERSION: u32 = 1;
+pub const FONT_IMAGE_HEADER_LEN: usize = 28;
+pub const FONT_IMAGE_BUILD_ID_OFFSET: usize = 24;
+pub const FONT_IMAGE_NAME_LEN: usize = 8;
+pub const FONT_IMAGE_DIR_ENTRY_LEN: usize = 20;
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    #[test]
+    fn fontmap_is_contiguous() {
+        assert_eq!(BOLD_OFFSET, 0);
+        assert_eq!(BOLD_OFFSET % FONT_ALIGN, 0);
+        assert_eq!(BOLD_LEN % 4, 0);
+        assert_eq!(EMOJI_OFFSET, ((BOLD_OFFSET + BOLD_LEN + FONT_ALIGN - 1) / FONT_ALIGN) * FONT_ALIGN);
+        assert_eq!(EMOJI_OFFSET % FONT_ALIGN, 0);
+        assert_eq!(EMOJI_LEN % 4, 0);
+        assert_eq!(HANZI_OFFSET, ((EMOJI_OFFSET + EMOJI_LEN + FONT_ALIGN - 1) / FONT_ALIGN) * FONT_ALIGN);
+        assert_eq!(HANZI_OFFSET % FONT_ALIGN, 0);
+        assert_eq!(HANZI_LEN % 4, 0);
+        assert_eq!(REGULAR_OFFSET, ((HANZI_OFFSET + HANZI_LEN + FONT_ALIGN - 1) / FONT_ALIGN) * FONT_ALIGN);
+        assert_eq!(REGULAR_OFFSET % FONT_ALIGN, 0);
+        assert_eq!(REGULAR_LEN % 4, 0);
+        assert_eq!(SMALL_OFFSET, ((REGULAR_OFFSET + REGULAR_LEN + FONT_ALIGN - 1) / FONT_ALIGN) * FONT_ALIGN);
+        assert_eq!(SMALL_OFFSET % FONT_ALIGN, 0);
+        assert_eq!(SMALL_LEN % 4, 0);
+        assert_eq!(FONT_TOTAL_LEN, ((SMALL_OFFSET + SMALL_LEN + FONT_ALIGN - 1) / FONT_ALIGN) * FONT_ALIGN);
+        assert_eq!(FONT_BASE % FONT_ALIGN, 0);
+    }
+    #[test]
+    fn fontmap_fits_in_flash() {
+        assert!(FONT_BASE + FONT_TOTAL_LEN <= FONT_LIMIT);
+        for font in FONT_TOC.iter() {
+            assert!(font.offset + font.len <= FONT_TOTAL_LEN);
+        }
+    }
+    #[test]
+    fn fontmap_matches_json() {
+        let json: String = include_str!("fontmap.json").split_whitespace().collect();
+        assert!(json.contains(&format!("\"font_base\":{},", FONT_BASE)));
+        assert!(json.contains(&format!("\"font_align\":{},", FONT_ALIGN)));
+        assert!(json.contains(&format!("\"font_total_len\":{},", FONT_TOTAL_LEN)));
+        assert!(json.contains(&format!("\"font_total_crc32\":{},", FONT_TOTAL_CRC32)));
+        assert!(json.contains(&format!("\"name\":\"bold\",\"offset\":{},\"len\":{},\"crc32\":{}", BOLD_OFFSET, BOLD_LEN, BOLD_CRC32)));
+        assert!(json.contains(&format!("\"name\":\"emoji\",\"offset\":{},\"len\":{},\"crc32\":{}", EMOJI_OFFSET, EMOJI_LEN, EMOJI_CRC32)));
+        assert!(json.contains(&format!("\"name\":\"hanzi\",\"offset\":{},\"len\":{},\"crc32\":{}", HANZI_OFFSET, HANZI_LEN, HANZI_CRC32)));
+        assert!(json.contains(&format!("\"name\":\"regular\",\"offset\":{},\"len\":{},\"crc32\":{}", REGULAR_OFFSET, REGULAR_LEN, REGULAR_CRC32)));
+        assert!(json.contains(&format!("\"name\":\"small\",\"offset\":{},\"len\":{},\"crc32\":{}", SMALL_OFFSET, SMALL_LEN, SMALL_CRC32)));
+    }
+}